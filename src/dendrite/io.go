@@ -3,22 +3,39 @@ package dendrite
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"github.com/fizx/logs"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var tr = &http.Transport{
-	TLSClientConfig:    nil,
-	DisableCompression: true,
-}
+const (
+	libratoMinBackoff   = 500 * time.Millisecond
+	libratoMaxBackoff   = 30 * time.Second
+	libratoMaxRetries   = 8
+	libratoMaxSpoolMB   = 100
+	libratoGzipMinBytes = 1024
+)
+
+const (
+	statsdDefaultMTU   = 1432
+	statsdDefaultFlush = 10 * time.Second
+)
 
 type noOpReader struct{}
 type rwStruct struct {
@@ -27,9 +44,25 @@ type rwStruct struct {
 }
 
 type libratoStruct struct {
-	url       *url.URL
-	responses chan string
-	metrics   chan []byte
+	url        *url.URL
+	responses  chan string
+	metrics    chan []byte
+	pending    [][]byte // batches awaiting (re)send; a retried batch stays at the head
+	spoolDir   string
+	maxRetries int
+	maxSpool   int64
+	stats      LibratoStats
+	done       chan struct{}
+	client     *http.Client
+}
+
+// LibratoStats is a snapshot of a libratoStruct's send counters, as returned
+// by Stats().
+type LibratoStats struct {
+	Submitted uint64
+	Retried   uint64
+	Dropped   uint64
+	Spooled   uint64
 }
 
 var EmptyReader = new(noOpReader)
@@ -38,25 +71,55 @@ func (er *noOpReader) Read(p []byte) (n int, err error) {
 	return 0, io.EOF
 }
 
-func NewReadWriter(u *url.URL) (io.ReadWriter, error) {
-	protocol := strings.Split(u.Scheme, "+")[0]
-	switch protocol {
-	case "file":
+// SchemeFactory builds an io.ReadWriter for a registered URL scheme. If the
+// returned value also implements io.Closer, NewReadWriter's caller can use
+// that to shut down any background goroutines the writer started.
+type SchemeFactory func(u *url.URL) (io.ReadWriter, error)
+
+var (
+	schemesMu sync.Mutex
+	schemes   = map[string]SchemeFactory{}
+)
+
+// RegisterScheme makes a protocol available to NewReadWriter under the given
+// scheme name. Downstream users can call this from their own init() to add
+// writers (Kafka, Kinesis, NATS, syslog, ...) without modifying this file.
+// Registering a name that's already taken replaces the existing factory.
+func RegisterScheme(name string, factory SchemeFactory) {
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	schemes[name] = factory
+}
+
+func init() {
+	RegisterScheme("file", func(u *url.URL) (io.ReadWriter, error) {
 		return NewFileReadWriter(u.Host + "/" + u.Path)
-	case "udp":
-		return NewUDPReadWriter(u)
-	case "tcp":
+	})
+	RegisterScheme("udp", NewUDPReadWriter)
+	RegisterScheme("tcp", func(u *url.URL) (io.ReadWriter, error) {
+		if strings.Contains(u.Scheme, "tls") {
+			return NewTLSReadWriter(u)
+		}
 		return NewTCPReadWriter(u)
-	case "librato":
-		return NewLibratoReadWriter(u)
-	case "tcps", "tcp+tls":
-		panic("not implemented")
-	case "http", "https":
-		panic("not implemented")
-	default:
+	})
+	RegisterScheme("tcps", NewTLSReadWriter)
+	RegisterScheme("librato", NewLibratoReadWriter)
+	RegisterScheme("statsd", NewStatsdReadWriter)
+	RegisterScheme("dogstatsd", NewStatsdReadWriter)
+	RegisterScheme("http", NewHTTPReadWriter)
+	RegisterScheme("https", NewHTTPReadWriter)
+}
+
+func NewReadWriter(u *url.URL) (io.ReadWriter, error) {
+	protocol := strings.Split(u.Scheme, "+")[0]
+
+	schemesMu.Lock()
+	factory, ok := schemes[protocol]
+	schemesMu.Unlock()
+	if !ok {
 		panic("unknown protocol")
 	}
-	return nil, nil //unreached
+	return factory(u)
 }
 
 func NewFileReadWriter(path string) (io.ReadWriter, error) {
@@ -83,49 +146,643 @@ func NewTCPReadWriter(u *url.URL) (io.ReadWriter, error) {
 	return &rwStruct{bufio.NewReader(conn), bufio.NewWriter(conn)}, nil
 }
 
+// tlsConfigFromQuery builds a *tls.Config from the "insecure" and "ca" URL
+// query params shared by every writer that can speak TLS (tcps/tcp+tls,
+// https, librato). It returns a zero-value config if neither is set.
+func tlsConfigFromQuery(q url.Values) (*tls.Config, error) {
+	config := &tls.Config{}
+	if insecure, _ := strconv.ParseBool(q.Get("insecure")); insecure {
+		config.InsecureSkipVerify = true
+	}
+	if ca := q.Get("ca"); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("dendrite: unable to parse CA bundle " + ca)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// httpTransportFromQuery builds a dedicated *http.Transport for a single
+// writer instance, honoring the same "insecure"/"ca" params as
+// tlsConfigFromQuery. Each writer gets its own transport rather than sharing
+// one across the process, so one writer's TLS settings can never bleed into
+// another's connections.
+func httpTransportFromQuery(q url.Values) (*http.Transport, error) {
+	tlsConfig, err := tlsConfigFromQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: 8,
+	}, nil
+}
+
+func NewTLSReadWriter(u *url.URL) (io.ReadWriter, error) {
+	serverName, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		serverName = u.Host
+	}
+
+	config, err := tlsConfigFromQuery(u.Query())
+	if err != nil {
+		return nil, err
+	}
+	config.ServerName = serverName
+
+	conn, err := tls.Dial("tcp", u.Host, config)
+	if err != nil {
+		return nil, err
+	}
+	return &rwStruct{bufio.NewReader(conn), bufio.NewWriter(conn)}, nil
+}
+
+// statsdStruct aggregates line-oriented StatsD/DogStatsD metrics written via
+// Write: counters are summed, gauges keep their latest value, and timers are
+// reduced to count/sum/min/max, all over a rolling flush interval. The
+// aggregated lines are then packed into UDP packets no larger than mtu,
+// never splitting a single metric across two packets (a metric that is
+// itself longer than mtu goes out alone, in one oversized packet), with lazy
+// socket reconnection on error.
+type statsdStruct struct {
+	addr    string
+	conn    net.Conn
+	metrics chan []byte
+	mtu     int
+	flush   time.Duration
+	done    chan struct{}
+}
+
+// statsdMetric identifies a single counter/gauge/timer being aggregated:
+// the same name can appear with different types or tags and must be
+// aggregated separately.
+type statsdMetric struct {
+	name string
+	typ  string
+	tags string
+}
+
+// statsdAgg accumulates metric samples between flushes.
+type statsdAgg struct {
+	meta     map[statsdMetric]bool
+	counters map[statsdMetric]float64
+	gauges   map[statsdMetric]float64
+	timers   map[statsdMetric][]float64
+}
+
+func newStatsdAgg() *statsdAgg {
+	return &statsdAgg{
+		meta:     make(map[statsdMetric]bool),
+		counters: make(map[statsdMetric]float64),
+		gauges:   make(map[statsdMetric]float64),
+		timers:   make(map[statsdMetric][]float64),
+	}
+}
+
+// add folds line into the aggregate. If line can't be parsed as
+// "name:value|type[|tags]" it's handed back unchanged so the caller can pass
+// it through unaggregated.
+func (a *statsdAgg) add(line []byte) []byte {
+	m, value, ok := parseStatsdLine(line)
+	if !ok {
+		return line
+	}
+	a.meta[m] = true
+	switch m.typ {
+	case "g":
+		a.gauges[m] = value
+	case "ms", "h":
+		a.timers[m] = append(a.timers[m], value)
+	default: // "c" and any other counter-like type
+		a.counters[m] += value
+	}
+	return nil
+}
+
+// flush renders the aggregate as StatsD lines and resets it for the next
+// interval.
+func (a *statsdAgg) flush() [][]byte {
+	lines := make([][]byte, 0, len(a.meta))
+	for m := range a.meta {
+		switch {
+		case m.typ == "g":
+			lines = append(lines, formatStatsdLine(m.name, a.gauges[m], m.typ, m.tags))
+		case m.typ == "ms" || m.typ == "h":
+			samples := a.timers[m]
+			min, max, sum := samples[0], samples[0], 0.0
+			for _, s := range samples {
+				if s < min {
+					min = s
+				}
+				if s > max {
+					max = s
+				}
+				sum += s
+			}
+			lines = append(lines,
+				formatStatsdLine(m.name+".count", float64(len(samples)), "c", m.tags),
+				formatStatsdLine(m.name+".sum", sum, m.typ, m.tags),
+				formatStatsdLine(m.name+".min", min, m.typ, m.tags),
+				formatStatsdLine(m.name+".max", max, m.typ, m.tags))
+		default:
+			lines = append(lines, formatStatsdLine(m.name, a.counters[m], m.typ, m.tags))
+		}
+	}
+
+	a.meta = make(map[statsdMetric]bool)
+	a.counters = make(map[statsdMetric]float64)
+	a.gauges = make(map[statsdMetric]float64)
+	a.timers = make(map[statsdMetric][]float64)
+	return lines
+}
+
+// parseStatsdLine parses "name:value|type" or DogStatsD's
+// "name:value|type|#tag:v,tag2:v2".
+func parseStatsdLine(line []byte) (m statsdMetric, value float64, ok bool) {
+	parts := bytes.Split(line, []byte("|"))
+	if len(parts) < 2 {
+		return
+	}
+	nv := bytes.SplitN(parts[0], []byte(":"), 2)
+	if len(nv) != 2 {
+		return
+	}
+	v, err := strconv.ParseFloat(string(nv[1]), 64)
+	if err != nil {
+		return
+	}
+	m.name = string(nv[0])
+	m.typ = string(parts[1])
+	if len(parts) >= 3 {
+		m.tags = string(parts[2])
+	}
+	value = v
+	ok = true
+	return
+}
+
+func formatStatsdLine(name string, value float64, typ, tags string) []byte {
+	line := name + ":" + strconv.FormatFloat(value, 'g', -1, 64) + "|" + typ
+	if tags != "" {
+		line += "|" + tags
+	}
+	return []byte(line)
+}
+
+func NewStatsdReadWriter(u *url.URL) (io.ReadWriter, error) {
+	q := u.Query()
+	mtu := statsdDefaultMTU
+	if n, err := strconv.Atoi(q.Get("mtu")); err == nil && n > 0 {
+		mtu = n
+	}
+	flush := statsdDefaultFlush
+	if d, err := time.ParseDuration(q.Get("flush")); err == nil && d > 0 {
+		flush = d
+	}
+
+	rw := &statsdStruct{
+		addr:    u.Host,
+		metrics: make(chan []byte, 1000),
+		mtu:     mtu,
+		flush:   flush,
+		done:    make(chan struct{}),
+	}
+	go rw.Loop()
+	return rw, nil
+}
+
+func (rw *statsdStruct) Loop() {
+	ticker := time.NewTicker(rw.flush)
+	defer ticker.Stop()
+
+	agg := newStatsdAgg()
+	var unparsed [][]byte
+
+	for {
+		select {
+		case <-rw.done:
+			if rw.conn != nil {
+				rw.conn.Close()
+			}
+			return
+		case msg := <-rw.metrics:
+			if line := agg.add(msg); line != nil {
+				unparsed = append(unparsed, line)
+			}
+		case <-ticker.C:
+			lines := append(agg.flush(), unparsed...)
+			unparsed = nil
+			rw.sendLines(lines)
+		}
+	}
+}
+
+// sendLines packs lines into UDP packets no larger than rw.mtu, never
+// splitting a single line across two packets. A line longer than rw.mtu is
+// sent on its own in a packet larger than rw.mtu.
+func (rw *statsdStruct) sendLines(lines [][]byte) {
+	buf := make([]byte, 0, rw.mtu)
+	for _, line := range lines {
+		if len(buf) > 0 && len(buf)+1+len(line) > rw.mtu {
+			rw.send(buf)
+			buf = buf[:0]
+		}
+		if len(buf) > 0 {
+			buf = append(buf, '\n')
+		}
+		buf = append(buf, line...)
+	}
+	if len(buf) > 0 {
+		rw.send(buf)
+	}
+}
+
+func (rw *statsdStruct) send(packet []byte) {
+	if rw.conn == nil {
+		conn, err := net.Dial("udp", rw.addr)
+		if err != nil {
+			logs.Error("statsd: error connecting to %s: %s", rw.addr, err)
+			return
+		}
+		rw.conn = conn
+	}
+	if _, err := rw.conn.Write(packet); err != nil {
+		logs.Error("statsd: error writing to %s: %s", rw.addr, err)
+		rw.conn.Close()
+		rw.conn = nil
+	}
+}
+
+// Close stops the background Loop goroutine, dropping whatever is currently
+// buffered. rw.conn is only ever touched from the Loop goroutine, so Close
+// just signals it and lets it close the connection itself rather than
+// racing with send().
+func (rw *statsdStruct) Close() error {
+	close(rw.done)
+	return nil
+}
+
+func (rw *statsdStruct) Read(p []byte) (int, error) {
+	return EmptyReader.Read(p)
+}
+
+func (rw *statsdStruct) Write(msg []byte) (int, error) {
+	rw.metrics <- msg
+	return len(msg), nil
+}
+
+// httpReadWriter streams Writes as the body of an HTTP request and exposes
+// the response through Read.
+type httpReadWriter struct {
+	body io.WriteCloser
+	resp io.ReadCloser
+}
+
+func NewHTTPReadWriter(u *url.URL) (io.ReadWriter, error) {
+	q := u.Query()
+	method := strings.ToUpper(q.Get("method"))
+	if method == "" {
+		method = "POST"
+	}
+	contentType := q.Get("content-type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	transport, err := httpTransportFromQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	target := *u
+	target.RawQuery = ""
+
+	bodyR, bodyW := io.Pipe()
+	respR, respW := io.Pipe()
+	rw := &httpReadWriter{body: bodyW, resp: respR}
+	go rw.run(method, contentType, &target, bodyR, respW, transport)
+	return rw, nil
+}
+
+func (rw *httpReadWriter) run(method, contentType string, u *url.URL, body io.Reader, respW *io.PipeWriter, transport *http.Transport) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		respW.CloseWithError(err)
+		return
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		respW.CloseWithError(err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(respW, resp.Body)
+	respW.Close()
+}
+
+func (rw *httpReadWriter) Read(p []byte) (int, error) {
+	return rw.resp.Read(p)
+}
+
+func (rw *httpReadWriter) Write(p []byte) (int, error) {
+	return rw.body.Write(p)
+}
+
+// Close unblocks run: closing body signals EOF on the request so a Do that's
+// still streaming it returns, and closing resp stops io.Copy from writing a
+// response into a reader nobody will drain anymore.
+func (rw *httpReadWriter) Close() error {
+	err := rw.body.Close()
+	if rerr := rw.resp.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
 func NewLibratoReadWriter(u *url.URL) (io.ReadWriter, error) {
 	rw := new(libratoStruct)
+
+	q := u.Query()
+	rw.spoolDir = q.Get("spool")
+	rw.maxRetries = libratoMaxRetries
+	if n, err := strconv.Atoi(q.Get("max_retries")); err == nil && n > 0 {
+		rw.maxRetries = n
+	}
+	rw.maxSpool = libratoMaxSpoolMB << 20
+	if n, err := strconv.Atoi(q.Get("max_spool_mb")); err == nil && n > 0 {
+		rw.maxSpool = int64(n) << 20
+	}
+	transport, err := httpTransportFromQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
 	rw.url = u
 	rw.url.Scheme = "https"
+	rw.url.RawQuery = ""
 	rw.metrics = make(chan []byte, 1000)
 	rw.responses = make(chan string, 1000)
+	rw.done = make(chan struct{})
+	rw.client = &http.Client{Transport: transport}
+
+	if rw.spoolDir != "" {
+		if err := os.MkdirAll(rw.spoolDir, 0755); err != nil {
+			return nil, err
+		}
+		rw.drainSpool()
+	}
+
 	go rw.Loop()
 	return rw, nil
 }
 
+// Loop drains rw.metrics into batches and hands them to Send, retrying the
+// head of rw.pending on failure. Batching and sending are both driven off
+// the same select so a steady stream of incoming metrics can't starve the
+// send/retry path: with no default case, Go picks fairly among whichever
+// cases are ready, instead of always preferring a ready rw.metrics over the
+// periodic send attempt.
 func (rw *libratoStruct) Loop() {
-	var msg []byte
 	limit := 300
 	msgs := make([][]byte, 0, limit)
+	attempt := 0
+
+	ticker := time.NewTicker(time.Second / 10)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(rw.pending) == 0 && len(msgs) > 0 {
+			rw.pending = append(rw.pending, buildGaugeBody(msgs))
+			msgs = msgs[:0]
+		}
+	}
+
 	for {
 		select {
-		case msg = <-rw.metrics:
+		case <-rw.done:
+			return
+		case msg := <-rw.metrics:
 			msgs = append(msgs, msg)
-			continue
-		default:
-			if len(msgs) > 0 {
-				rw.Send(msgs)
-				msgs = msgs[0:0]
+			if len(msgs) >= limit {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+			if len(rw.pending) == 0 {
+				continue
+			}
+			ok, retryAfter := rw.Send(rw.pending[0])
+			if ok {
+				rw.pending = rw.pending[1:]
+				attempt = 0
+				continue
+			}
+			attempt++
+			atomic.AddUint64(&rw.stats.Retried, 1)
+			if attempt > rw.maxRetries {
+				rw.spoolOrDrop(rw.pending[0])
+				rw.pending = rw.pending[1:]
+				attempt = 0
+			} else if retryAfter > 0 {
+				rw.interruptibleSleep(retryAfter)
+			} else {
+				rw.interruptibleSleep(libratoBackoff(attempt))
 			}
 		}
-		time.Sleep(time.Second / 10)
 	}
 }
 
-func (rw *libratoStruct) Send(msgs [][]byte) {
-	body := "{\"gauges\": [" + string(bytes.Join(msgs, []byte(","))) + "]}"
-	resp, err := http.Post(rw.url.String(), "application/json", bytes.NewBufferString(body))
+// interruptibleSleep waits for d, but returns early if Close is called so a
+// pending backoff or Retry-After pause (up to libratoMaxBackoff, or
+// whatever a server asks for) never delays shutdown.
+func (rw *libratoStruct) interruptibleSleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-rw.done:
+	}
+}
+
+func buildGaugeBody(msgs [][]byte) []byte {
+	return []byte("{\"gauges\": [" + string(bytes.Join(msgs, []byte(","))) + "]}")
+}
+
+// libratoBackoff returns the delay before retry number attempt, growing
+// exponentially from libratoMinBackoff to libratoMaxBackoff with up to 50%
+// jitter so that a fleet of writers doesn't retry in lockstep.
+func libratoBackoff(attempt int) time.Duration {
+	d := libratoMinBackoff << uint(attempt-1)
+	if d <= 0 || d > libratoMaxBackoff {
+		d = libratoMaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// spoolOrDrop is called once a batch has exhausted its retries. If a spool
+// directory is configured and has room, the batch is written to disk to be
+// retried on the next restart; otherwise it is dropped.
+func (rw *libratoStruct) spoolOrDrop(body []byte) {
+	if rw.spoolDir == "" {
+		atomic.AddUint64(&rw.stats.Dropped, 1)
+		logs.Error("dendrite: dropping librato batch of %d bytes after %d retries", len(body), rw.maxRetries)
+		return
+	}
+	if rw.spoolSize()+int64(len(body)) > rw.maxSpool {
+		atomic.AddUint64(&rw.stats.Dropped, 1)
+		logs.Error("dendrite: spool directory %s full, dropping librato batch", rw.spoolDir)
+		return
+	}
+	name := filepath.Join(rw.spoolDir, fmt.Sprintf("%d.json", time.Now().UnixNano()))
+	if err := ioutil.WriteFile(name, body, 0644); err != nil {
+		atomic.AddUint64(&rw.stats.Dropped, 1)
+		logs.Error("dendrite: error spooling librato batch to %s: %s", name, err)
+		return
+	}
+	atomic.AddUint64(&rw.stats.Spooled, 1)
+}
+
+func (rw *libratoStruct) spoolSize() int64 {
+	entries, err := ioutil.ReadDir(rw.spoolDir)
 	if err != nil {
-		logs.Error("error on http request: %s", err)
-	} else {
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
+		return 0
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.Size()
+	}
+	return total
+}
+
+// drainSpool loads any batches left over from a previous run, oldest first,
+// so they're retried before new metrics are sent.
+func (rw *libratoStruct) drainSpool() {
+	entries, err := ioutil.ReadDir(rw.spoolDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		path := filepath.Join(rw.spoolDir, e.Name())
+		body, err := ioutil.ReadFile(path)
 		if err != nil {
-			logs.Error("error reading http response: %s", err)
+			logs.Error("dendrite: error reading spooled librato batch %s: %s", path, err)
+			continue
+		}
+		rw.pending = append(rw.pending, body)
+		os.Remove(path)
+	}
+}
+
+// Send posts body to Librato, returning true on a 2xx response. On a 429 or
+// 503 it also returns the duration the server asked us to wait via
+// Retry-After, if any. The caller is responsible for retrying or spooling on
+// failure.
+func (rw *libratoStruct) Send(body []byte) (ok bool, retryAfter time.Duration) {
+	payload := body
+	contentEncoding := ""
+	if len(body) >= libratoGzipMinBytes {
+		gzipped, err := gzipBytes(body)
+		if err != nil {
+			logs.Error("error gzipping librato body: %s", err)
 		} else {
-			rw.responses <- resp.Status + "\n" + string(body)
+			payload = gzipped
+			contentEncoding = "gzip"
+		}
+	}
+
+	req, err := http.NewRequest("POST", rw.url.String(), bytes.NewReader(payload))
+	if err != nil {
+		logs.Error("error building http request: %s", err)
+		return false, 0
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		logs.Error("error on http request: %s", err)
+		return false, 0
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logs.Error("error reading http response: %s", err)
+		return false, 0
+	}
+
+	if resp.StatusCode == 429 || resp.StatusCode == 503 {
+		retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		logs.Error("librato returned %s: %s", resp.Status, respBody)
+		return false, retryAfter
+	}
+
+	atomic.AddUint64(&rw.stats.Submitted, 1)
+	rw.responses <- resp.Status + "\n" + string(respBody)
+	return true, 0
+}
+
+func gzipBytes(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parseRetryAfter accepts either form of the Retry-After header (a delay in
+// seconds or an HTTP-date) and returns the remaining wait, or 0 if absent or
+// unparseable.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
 		}
 	}
+	return 0
+}
+
+// Stats returns a snapshot of this writer's submitted/retried/dropped/spooled
+// counters.
+func (rw *libratoStruct) Stats() LibratoStats {
+	return LibratoStats{
+		Submitted: atomic.LoadUint64(&rw.stats.Submitted),
+		Retried:   atomic.LoadUint64(&rw.stats.Retried),
+		Dropped:   atomic.LoadUint64(&rw.stats.Dropped),
+		Spooled:   atomic.LoadUint64(&rw.stats.Spooled),
+	}
+}
+
+// Close stops the background Loop goroutine. Any batch in flight is
+// abandoned; anything already spooled to disk will still be picked up by a
+// future NewLibratoReadWriter against the same spool directory.
+func (rw *libratoStruct) Close() error {
+	close(rw.done)
+	return nil
 }
 
 func (rw *libratoStruct) Read(buf []byte) (int, error) {
@@ -0,0 +1,170 @@
+package dendrite
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseStatsdLine(t *testing.T) {
+	cases := []struct {
+		line  string
+		ok    bool
+		name  string
+		typ   string
+		tags  string
+		value float64
+	}{
+		{line: "foo:1|c", ok: true, name: "foo", typ: "c", value: 1},
+		{line: "foo.bar:2.5|g", ok: true, name: "foo.bar", typ: "g", value: 2.5},
+		{line: "foo:3|ms|#tag:v,other:1", ok: true, name: "foo", typ: "ms", tags: "#tag:v,other:1", value: 3},
+		{line: "malformed", ok: false},
+		{line: "foo|c", ok: false},
+		{line: "foo:notanumber|c", ok: false},
+	}
+
+	for _, c := range cases {
+		m, v, ok := parseStatsdLine([]byte(c.line))
+		if ok != c.ok {
+			t.Errorf("parseStatsdLine(%q) ok = %v, want %v", c.line, ok, c.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if m.name != c.name || m.typ != c.typ || m.tags != c.tags || v != c.value {
+			t.Errorf("parseStatsdLine(%q) = %+v, %v; want {%q %q %q}, %v",
+				c.line, m, v, c.name, c.typ, c.tags, c.value)
+		}
+	}
+}
+
+func TestStatsdAggAddPassesThroughUnparsable(t *testing.T) {
+	a := newStatsdAgg()
+	line := a.add([]byte("not-a-metric"))
+	if string(line) != "not-a-metric" {
+		t.Fatalf("expected unparsable line to be returned unchanged, got %q", line)
+	}
+	if len(a.flush()) != 0 {
+		t.Fatalf("unparsable line should not be folded into the aggregate")
+	}
+}
+
+func TestStatsdAggFlush(t *testing.T) {
+	a := newStatsdAgg()
+	for _, line := range []string{"hits:1|c", "hits:2|c", "temp:5|g", "temp:7|g", "latency:10|ms", "latency:30|ms"} {
+		if rest := a.add([]byte(line)); rest != nil {
+			t.Fatalf("add(%q) unexpectedly passed through as unparsable", line)
+		}
+	}
+
+	got := map[string]bool{}
+	for _, line := range a.flush() {
+		got[string(line)] = true
+	}
+	for _, want := range []string{
+		"hits:3|c",
+		"temp:7|g",
+		"latency.count:2|c",
+		"latency.sum:40|ms",
+		"latency.min:10|ms",
+		"latency.max:30|ms",
+	} {
+		if !got[want] {
+			t.Errorf("flush() missing %q, got %v", want, got)
+		}
+	}
+
+	if rest := a.flush(); len(rest) != 0 {
+		t.Errorf("flush() should reset the aggregate, got %v", rest)
+	}
+}
+
+func TestLibratoBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		d := libratoBackoff(attempt)
+		if d <= 0 || d > libratoMaxBackoff {
+			t.Errorf("libratoBackoff(%d) = %v, want (0, %v]", attempt, d, libratoMaxBackoff)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter(""); d != 0 {
+		t.Errorf("parseRetryAfter(\"\") = %v, want 0", d)
+	}
+	if d := parseRetryAfter("120"); d != 120*time.Second {
+		t.Errorf("parseRetryAfter(\"120\") = %v, want 120s", d)
+	}
+	if d := parseRetryAfter("not-a-date"); d != 0 {
+		t.Errorf("parseRetryAfter(\"not-a-date\") = %v, want 0", d)
+	}
+
+	future := time.Now().Add(5 * time.Minute).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(future); d <= 0 || d > 5*time.Minute+time.Second {
+		t.Errorf("parseRetryAfter(%q) = %v, want ~5m", future, d)
+	}
+}
+
+func TestLibratoSpoolOrDrop(t *testing.T) {
+	dir := t.TempDir()
+	rw := &libratoStruct{spoolDir: dir, maxSpool: 1 << 20}
+
+	rw.spoolOrDrop([]byte(`{"gauges":[]}`))
+
+	if got := rw.Stats().Spooled; got != 1 {
+		t.Fatalf("Stats().Spooled = %d, want 1", got)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("spool dir has %d files, want 1", len(entries))
+	}
+}
+
+func TestLibratoSpoolOrDropWithoutSpoolDirDrops(t *testing.T) {
+	rw := &libratoStruct{}
+
+	rw.spoolOrDrop([]byte("x"))
+
+	if got := rw.Stats().Dropped; got != 1 {
+		t.Fatalf("Stats().Dropped = %d, want 1", got)
+	}
+}
+
+func TestLibratoSpoolOrDropRespectsMaxSpool(t *testing.T) {
+	dir := t.TempDir()
+	rw := &libratoStruct{spoolDir: dir, maxSpool: 4}
+
+	rw.spoolOrDrop([]byte("this batch is well over four bytes"))
+
+	if got := rw.Stats().Dropped; got != 1 {
+		t.Fatalf("Stats().Dropped = %d, want 1", got)
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("spool dir has %d files, want 0", len(entries))
+	}
+}
+
+func TestLibratoDrainSpool(t *testing.T) {
+	dir := t.TempDir()
+
+	producer := &libratoStruct{spoolDir: dir, maxSpool: 1 << 20}
+	producer.spoolOrDrop([]byte("batch-1"))
+	producer.spoolOrDrop([]byte("batch-2"))
+
+	rw := &libratoStruct{spoolDir: dir}
+	rw.drainSpool()
+
+	if len(rw.pending) != 2 {
+		t.Fatalf("drainSpool() loaded %d batches, want 2", len(rw.pending))
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("spool dir has %d files after drain, want 0", len(entries))
+	}
+}